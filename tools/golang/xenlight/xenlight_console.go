@@ -0,0 +1,217 @@
+/*
+ * Copyright (C) 2019 Nicolas Belouin, Gandi SAS
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+package xenlight
+
+/*
+#include <stdlib.h>
+#include <libxl.h>
+#include <libxl_utils.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// ConsoleType mirrors libxl_console_type: which of a domain's consoles
+// to attach to.
+type ConsoleType int
+
+const (
+	ConsoleTypeSerial ConsoleType = iota
+	ConsoleTypePv
+)
+
+// int libxl_primary_console_get_tty(libxl_ctx *ctx, uint32_t domid, char **path);
+func (Ctx *Context) PrimaryConsoleGetTty(domid uint32) (string, error) {
+	var cPath *C.char
+
+	ret := C.libxl_primary_console_get_tty(Ctx.ctx, C.uint32_t(domid), &cPath)
+	if ret != 0 {
+		return "", Error(-ret)
+	}
+	defer C.free(unsafe.Pointer(cPath))
+
+	return C.GoString(cPath), nil
+}
+
+// int libxl_console_get_tty(libxl_ctx *ctx, uint32_t domid, int cons_num, libxl_console_type type, char **path);
+func (Ctx *Context) ConsoleGetTty(domid uint32, consNum int, kind ConsoleType) (string, error) {
+	var cPath *C.char
+
+	ret := C.libxl_console_get_tty(Ctx.ctx, C.uint32_t(domid), C.int(consNum),
+		C.libxl_console_type(kind), &cPath)
+	if ret != 0 {
+		return "", Error(-ret)
+	}
+	defer C.free(unsafe.Pointer(cPath))
+
+	return C.GoString(cPath), nil
+}
+
+// consoleEscape is the "Ctrl-]" byte xl console uses to detach from a
+// guest console.
+const consoleEscape = 0x1d
+
+// ConsoleExec opens domid's console of the given kind, puts the
+// controlling terminal into raw mode, and proxies bytes between the
+// terminal and the console tty until the user presses Ctrl-], matching
+// `xl console`'s behavior. It restores terminal state before returning.
+func (Ctx *Context) ConsoleExec(domid Domid, kind ConsoleType) error {
+	var (
+		path string
+		err  error
+	)
+
+	if kind == ConsoleTypeSerial {
+		path, err = Ctx.PrimaryConsoleGetTty(uint32(domid))
+	} else {
+		path, err = Ctx.ConsoleGetTty(uint32(domid), 0, kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	tty, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("xenlight: opening console tty %s: %w", path, err)
+	}
+
+	fd := int(os.Stdin.Fd())
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		tty.Close()
+		return fmt.Errorf("xenlight: putting terminal into raw mode: %w", err)
+	}
+	defer term.Restore(fd, oldState)
+
+	cancel, err := newSelfPipe()
+	if err != nil {
+		tty.Close()
+		return fmt.Errorf("xenlight: setting up console cancellation: %w", err)
+	}
+	defer cancel.close()
+
+	errCh := make(chan error, 2)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		errCh <- copyStdinUntilEscape(tty, fd, cancel)
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(os.Stdout, tty)
+		errCh <- err
+	}()
+
+	err = <-errCh
+
+	// Unblock whichever direction is still copying: closing tty ends
+	// the tty->stdout io.Copy, and signalling cancel ends the
+	// stdin->tty read that would otherwise sit blocked on the
+	// terminal forever. Only then is it safe to wait for both
+	// goroutines and return.
+	cancel.signal()
+	tty.Close()
+	wg.Wait()
+
+	return err
+}
+
+// selfPipe lets copyStdinUntilEscape's blocking read on stdin be
+// cancelled: writing to w wakes up the unix.Poll call that's also
+// watching r, even though stdin itself has nothing to read.
+type selfPipe struct {
+	r, w *os.File
+}
+
+func newSelfPipe() (*selfPipe, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	return &selfPipe{r: r, w: w}, nil
+}
+
+func (p *selfPipe) signal() {
+	p.w.Write([]byte{0})
+}
+
+func (p *selfPipe) close() {
+	p.r.Close()
+	p.w.Close()
+}
+
+// copyStdinUntilEscape copies bytes read from stdinFd to dst, stopping
+// (without error) as soon as it sees the console escape byte or
+// cancel is signalled.
+func copyStdinUntilEscape(dst io.Writer, stdinFd int, cancel *selfPipe) error {
+	buf := make([]byte, 1)
+	pollFds := []unix.PollFd{
+		{Fd: int32(stdinFd), Events: unix.POLLIN},
+		{Fd: int32(cancel.r.Fd()), Events: unix.POLLIN},
+	}
+
+	for {
+		pollFds[0].Revents = 0
+		pollFds[1].Revents = 0
+
+		if _, err := unix.Poll(pollFds, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return err
+		}
+
+		if pollFds[1].Revents&unix.POLLIN != 0 {
+			return nil
+		}
+		if pollFds[0].Revents&unix.POLLIN == 0 {
+			continue
+		}
+
+		n, err := unix.Read(stdinFd, buf)
+		if n > 0 {
+			if buf[0] == consoleEscape {
+				return nil
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,443 @@
+/*
+ * Copyright (C) 2019 Nicolas Belouin, Gandi SAS
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+package xenlight
+
+/*
+#include <stdlib.h>
+#include <libxl.h>
+#include <libxl_utils.h>
+#include "xenlight_device.h"
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+// Devid is the libxl device index of a nic, disk, or other device
+// attached to a domain.
+type Devid int
+
+// DeviceNic mirrors libxl_device_nic. It describes a virtual network
+// interface that can be attached to or detached from a running domain.
+type DeviceNic struct {
+	Backend Domid
+	Devid   Devid
+	Mtu     int
+	Model   string
+	Mac     [6]byte
+	Ip      string
+	Bridge  string
+	Ifname  string
+	Script  string
+	Nictype int
+	Rate    uint64
+}
+
+func (nic *DeviceNic) toC() (cNic C.libxl_device_nic, err error) {
+	C.libxl_device_nic_init(&cNic)
+
+	cNic.backend_domid = C.uint32_t(nic.Backend)
+	cNic.devid = C.int(nic.Devid)
+	cNic.mtu = C.int(nic.Mtu)
+	cNic.nictype = C.libxl_nic_type(nic.Nictype)
+
+	for i, b := range nic.Mac {
+		cNic.mac[i] = C.uint8_t(b)
+	}
+
+	if nic.Model != "" {
+		cNic.model = C.CString(nic.Model)
+	}
+	if nic.Ip != "" {
+		cNic.ip = C.CString(nic.Ip)
+	}
+	if nic.Bridge != "" {
+		cNic.bridge = C.CString(nic.Bridge)
+	}
+	if nic.Ifname != "" {
+		cNic.ifname = C.CString(nic.Ifname)
+	}
+	if nic.Script != "" {
+		cNic.script = C.CString(nic.Script)
+	}
+
+	return
+}
+
+func (nic *DeviceNic) fromC(cNic *C.libxl_device_nic) error {
+	nic.Backend = Domid(cNic.backend_domid)
+	nic.Devid = Devid(cNic.devid)
+	nic.Mtu = int(cNic.mtu)
+	nic.Nictype = int(cNic.nictype)
+
+	for i := range nic.Mac {
+		nic.Mac[i] = byte(cNic.mac[i])
+	}
+
+	nic.Model = C.GoString(cNic.model)
+	nic.Ip = C.GoString(cNic.ip)
+	nic.Bridge = C.GoString(cNic.bridge)
+	nic.Ifname = C.GoString(cNic.ifname)
+	nic.Script = C.GoString(cNic.script)
+
+	return nil
+}
+
+// DevicePci mirrors libxl_device_pci. It identifies a PCI device by its
+// domain:bus:dev.func BDF address, plus a handful of passthrough options.
+type DevicePci struct {
+	Domain       uint16
+	Bus          uint8
+	Dev          uint8
+	Func         uint8
+	VdevFn       uint32
+	VFuncMask    uint32
+	MsiTranslate bool
+	PowerMgmt    bool
+	Permissive   bool
+	Seize        bool
+}
+
+func (pci *DevicePci) toC() (cPci C.libxl_device_pci, err error) {
+	C.libxl_device_pci_init(&cPci)
+
+	cPci.domain = C.uint16_t(pci.Domain)
+	cPci.bus = C.uint8_t(pci.Bus)
+	cPci.dev = C.uint8_t(pci.Dev)
+	cPci.func_ = C.uint8_t(pci.Func)
+	cPci.vdevfn = C.uint32_t(pci.VdevFn)
+	cPci.vfunc_mask = C.uint32_t(pci.VFuncMask)
+	C.libxl_defbool_set(&cPci.msitranslate, C.bool(pci.MsiTranslate))
+	C.libxl_defbool_set(&cPci.power_mgmt, C.bool(pci.PowerMgmt))
+	C.libxl_defbool_set(&cPci.permissive, C.bool(pci.Permissive))
+	C.libxl_defbool_set(&cPci.seize, C.bool(pci.Seize))
+
+	return
+}
+
+func (pci *DevicePci) fromC(cPci *C.libxl_device_pci) error {
+	pci.Domain = uint16(cPci.domain)
+	pci.Bus = uint8(cPci.bus)
+	pci.Dev = uint8(cPci.dev)
+	pci.Func = uint8(cPci.func_)
+	pci.VdevFn = uint32(cPci.vdevfn)
+	pci.VFuncMask = uint32(cPci.vfunc_mask)
+	pci.MsiTranslate = bool(C.libxl_defbool_val(cPci.msitranslate))
+	pci.PowerMgmt = bool(C.libxl_defbool_val(cPci.power_mgmt))
+	pci.Permissive = bool(C.libxl_defbool_val(cPci.permissive))
+	pci.Seize = bool(C.libxl_defbool_val(cPci.seize))
+
+	return nil
+}
+
+// USBDevType identifies which member of the libxl_device_usbdev union
+// below is populated.
+type USBDevType int
+
+const (
+	// USBDevTypeHostdev attaches a specific host USB device, identified
+	// by Hostbus/Hostaddr, to the guest.
+	USBDevTypeHostdev USBDevType = iota
+)
+
+// DeviceUsbdev mirrors libxl_device_usbdev. Only the host-passthrough
+// case is represented; Hostbus/Hostaddr are ignored for other types.
+type DeviceUsbdev struct {
+	Backend  Domid
+	Devid    Devid
+	Type     USBDevType
+	Hostbus  uint8
+	Hostaddr uint8
+}
+
+func (usb *DeviceUsbdev) toC() (cUsb C.libxl_device_usbdev, err error) {
+	C.libxl_device_usbdev_init(&cUsb)
+
+	cUsb.backend_domid = C.uint32_t(usb.Backend)
+	cUsb.devid = C.int(usb.Devid)
+
+	switch usb.Type {
+	case USBDevTypeHostdev:
+		C.xenlight_usbdev_hostdev_set(&cUsb, C.uint8_t(usb.Hostbus), C.uint8_t(usb.Hostaddr))
+	}
+
+	return
+}
+
+func (usb *DeviceUsbdev) fromC(cUsb *C.libxl_device_usbdev) error {
+	usb.Backend = Domid(cUsb.backend_domid)
+	usb.Devid = Devid(cUsb.devid)
+
+	var cHostbus, cHostaddr C.uint8_t
+	C.xenlight_usbdev_hostdev_get(cUsb, &cHostbus, &cHostaddr)
+	usb.Hostbus = uint8(cHostbus)
+	usb.Hostaddr = uint8(cHostaddr)
+
+	return nil
+}
+
+// retErr translates a libxl return code into an Error. It's the
+// building block deviceOp/deviceOpAsync use once their C call
+// returns, and is also used directly by the many libxl calls in this
+// package that have no Go struct to convert and simply report success
+// or failure as an int.
+func retErr(ret C.int) error {
+	if ret != 0 {
+		return Error(-ret)
+	}
+
+	return nil
+}
+
+// deviceOp runs the toC/dispose/call/translate sequence shared by
+// every synchronous Device*Add/Remove/Assignable* call below: convert
+// the device to its C counterpart with toC, invoke call with it and how (nil for a
+// synchronous call), translate a non-zero libxl return code into an
+// Error, and dispose of the C struct once call returns either way.
+func deviceOp[T any](toC func() (T, error), dispose func(*T), call func(*T, *C.libxl_asyncop_how) C.int, how *C.libxl_asyncop_how) error {
+	cDev, err := toC()
+	if err != nil {
+		return err
+	}
+	defer dispose(&cDev)
+
+	return retErr(call(&cDev, how))
+}
+
+// deviceOpAsync is deviceOp's asynchronous counterpart: it registers a
+// new AsyncOp, passes its libxl_asyncop_how to call in place of nil,
+// and returns the AsyncOp for the caller to wait on. ret only reports
+// that libxl accepted the request; completion arrives on op.Done() via
+// Ctx's event loop.
+func deviceOpAsync[T any](toC func() (T, error), dispose func(*T), call func(*T, *C.libxl_asyncop_how) C.int) (*AsyncOp, error) {
+	cDev, err := toC()
+	if err != nil {
+		return nil, err
+	}
+	defer dispose(&cDev)
+
+	op, how := newAsyncOp()
+	if err := retErr(call(&cDev, &how)); err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+func nicDispose(c *C.libxl_device_nic) { C.libxl_device_nic_dispose(c) }
+
+// int libxl_device_nic_add(libxl_ctx *ctx, uint32_t domid, libxl_device_nic *nic, const libxl_asyncop_how *ao_how);
+func (Ctx *Context) DeviceNicAdd(id Domid, nic *DeviceNic) error {
+	return deviceOp(nic.toC, nicDispose, func(c *C.libxl_device_nic, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_nic_add(Ctx.ctx, C.uint32_t(id), c, how)
+	}, nil)
+}
+
+// int libxl_device_nic_remove(libxl_ctx *ctx, uint32_t domid, libxl_device_nic *nic, const libxl_asyncop_how *ao_how);
+func (Ctx *Context) DeviceNicRemove(id Domid, nic *DeviceNic) error {
+	return deviceOp(nic.toC, nicDispose, func(c *C.libxl_device_nic, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_nic_remove(Ctx.ctx, C.uint32_t(id), c, how)
+	}, nil)
+}
+
+// DeviceNicAddAsync is the asynchronous counterpart of DeviceNicAdd. The
+// returned AsyncOp's Done channel receives the completion once Ctx's
+// event loop (see EventRegisterCallbacks) delivers it.
+func (Ctx *Context) DeviceNicAddAsync(id Domid, nic *DeviceNic) (*AsyncOp, error) {
+	return deviceOpAsync(nic.toC, nicDispose, func(c *C.libxl_device_nic, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_nic_add(Ctx.ctx, C.uint32_t(id), c, how)
+	})
+}
+
+// DeviceNicRemoveAsync is the asynchronous counterpart of DeviceNicRemove.
+func (Ctx *Context) DeviceNicRemoveAsync(id Domid, nic *DeviceNic) (*AsyncOp, error) {
+	return deviceOpAsync(nic.toC, nicDispose, func(c *C.libxl_device_nic, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_nic_remove(Ctx.ctx, C.uint32_t(id), c, how)
+	})
+}
+
+// int libxl_device_nic_list(libxl_ctx *ctx, uint32_t domid, int *num);
+func (Ctx *Context) DeviceNicList(id Domid) (nics []DeviceNic, err error) {
+	var cNum C.int
+
+	cNics := C.libxl_device_nic_list(Ctx.ctx, C.uint32_t(id), &cNum)
+	if cNics == nil {
+		return
+	}
+	defer C.libxl_device_nic_list_free(cNics, cNum)
+
+	cNicSlice := unsafe.Slice(cNics, int(cNum))
+
+	nics = make([]DeviceNic, cNum)
+	for i := range nics {
+		if err = nics[i].fromC(&cNicSlice[i]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func pciDispose(c *C.libxl_device_pci) { C.libxl_device_pci_dispose(c) }
+
+// int libxl_device_pci_add(libxl_ctx *ctx, uint32_t domid, libxl_device_pci *pcidev, const libxl_asyncop_how *ao_how);
+func (Ctx *Context) DevicePciAdd(id Domid, pcidev *DevicePci) error {
+	return deviceOp(pcidev.toC, pciDispose, func(c *C.libxl_device_pci, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_pci_add(Ctx.ctx, C.uint32_t(id), c, how)
+	}, nil)
+}
+
+// int libxl_device_pci_remove(libxl_ctx *ctx, uint32_t domid, libxl_device_pci *pcidev, const libxl_asyncop_how *ao_how);
+func (Ctx *Context) DevicePciRemove(id Domid, pcidev *DevicePci) error {
+	return deviceOp(pcidev.toC, pciDispose, func(c *C.libxl_device_pci, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_pci_remove(Ctx.ctx, C.uint32_t(id), c, how)
+	}, nil)
+}
+
+// DevicePciAddAsync is the asynchronous counterpart of DevicePciAdd.
+func (Ctx *Context) DevicePciAddAsync(id Domid, pcidev *DevicePci) (*AsyncOp, error) {
+	return deviceOpAsync(pcidev.toC, pciDispose, func(c *C.libxl_device_pci, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_pci_add(Ctx.ctx, C.uint32_t(id), c, how)
+	})
+}
+
+// DevicePciRemoveAsync is the asynchronous counterpart of DevicePciRemove.
+func (Ctx *Context) DevicePciRemoveAsync(id Domid, pcidev *DevicePci) (*AsyncOp, error) {
+	return deviceOpAsync(pcidev.toC, pciDispose, func(c *C.libxl_device_pci, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_pci_remove(Ctx.ctx, C.uint32_t(id), c, how)
+	})
+}
+
+// libxl_device_pci *libxl_device_pci_list(libxl_ctx *ctx, uint32_t domid, int *num);
+func (Ctx *Context) DevicePciList(id Domid) (pcidevs []DevicePci, err error) {
+	var cNum C.int
+
+	cPcis := C.libxl_device_pci_list(Ctx.ctx, C.uint32_t(id), &cNum)
+	if cPcis == nil {
+		return
+	}
+	defer C.libxl_device_pci_list_free(cPcis, cNum)
+
+	cPciSlice := unsafe.Slice(cPcis, int(cNum))
+
+	pcidevs = make([]DevicePci, cNum)
+	for i := range pcidevs {
+		if err = pcidevs[i].fromC(&cPciSlice[i]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// int libxl_device_pci_assignable_add(libxl_ctx *ctx, libxl_device_pci *pcidev, int rebind);
+func (Ctx *Context) DevicePciAssignableAdd(pcidev *DevicePci, rebind bool) error {
+	return deviceOp(pcidev.toC, pciDispose, func(c *C.libxl_device_pci, _ *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_pci_assignable_add(Ctx.ctx, c, C.int(boolToCInt(rebind)))
+	}, nil)
+}
+
+// int libxl_device_pci_assignable_remove(libxl_ctx *ctx, libxl_device_pci *pcidev, int rebind);
+func (Ctx *Context) DevicePciAssignableRemove(pcidev *DevicePci, rebind bool) error {
+	return deviceOp(pcidev.toC, pciDispose, func(c *C.libxl_device_pci, _ *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_pci_assignable_remove(Ctx.ctx, c, C.int(boolToCInt(rebind)))
+	}, nil)
+}
+
+// libxl_device_pci *libxl_device_pci_assignable_list(libxl_ctx *ctx, int *num);
+func (Ctx *Context) DevicePciAssignableList() (pcidevs []DevicePci, err error) {
+	var cNum C.int
+
+	cPcis := C.libxl_device_pci_assignable_list(Ctx.ctx, &cNum)
+	if cPcis == nil {
+		return
+	}
+	defer C.free(unsafe.Pointer(cPcis))
+
+	cPciSlice := unsafe.Slice(cPcis, int(cNum))
+
+	pcidevs = make([]DevicePci, cNum)
+	for i := range pcidevs {
+		if err = pcidevs[i].fromC(&cPciSlice[i]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func usbdevDispose(c *C.libxl_device_usbdev) { C.libxl_device_usbdev_dispose(c) }
+
+// int libxl_device_usbdev_add(libxl_ctx *ctx, uint32_t domid, libxl_device_usbdev *usbdev, const libxl_asyncop_how *ao_how);
+func (Ctx *Context) DeviceUsbdevAdd(id Domid, usbdev *DeviceUsbdev) error {
+	return deviceOp(usbdev.toC, usbdevDispose, func(c *C.libxl_device_usbdev, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_usbdev_add(Ctx.ctx, C.uint32_t(id), c, how)
+	}, nil)
+}
+
+// int libxl_device_usbdev_remove(libxl_ctx *ctx, uint32_t domid, libxl_device_usbdev *usbdev, const libxl_asyncop_how *ao_how);
+func (Ctx *Context) DeviceUsbdevRemove(id Domid, usbdev *DeviceUsbdev) error {
+	return deviceOp(usbdev.toC, usbdevDispose, func(c *C.libxl_device_usbdev, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_usbdev_remove(Ctx.ctx, C.uint32_t(id), c, how)
+	}, nil)
+}
+
+// DeviceUsbdevAddAsync is the asynchronous counterpart of DeviceUsbdevAdd.
+func (Ctx *Context) DeviceUsbdevAddAsync(id Domid, usbdev *DeviceUsbdev) (*AsyncOp, error) {
+	return deviceOpAsync(usbdev.toC, usbdevDispose, func(c *C.libxl_device_usbdev, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_usbdev_add(Ctx.ctx, C.uint32_t(id), c, how)
+	})
+}
+
+// DeviceUsbdevRemoveAsync is the asynchronous counterpart of
+// DeviceUsbdevRemove.
+func (Ctx *Context) DeviceUsbdevRemoveAsync(id Domid, usbdev *DeviceUsbdev) (*AsyncOp, error) {
+	return deviceOpAsync(usbdev.toC, usbdevDispose, func(c *C.libxl_device_usbdev, how *C.libxl_asyncop_how) C.int {
+		return C.libxl_device_usbdev_remove(Ctx.ctx, C.uint32_t(id), c, how)
+	})
+}
+
+// libxl_device_usbdev *libxl_device_usbdev_list(libxl_ctx *ctx, uint32_t domid, int *num);
+func (Ctx *Context) DeviceUsbdevList(id Domid) (usbdevs []DeviceUsbdev, err error) {
+	var cNum C.int
+
+	cUsbs := C.libxl_device_usbdev_list(Ctx.ctx, C.uint32_t(id), &cNum)
+	if cUsbs == nil {
+		return
+	}
+	defer C.libxl_device_usbdev_list_free(cUsbs, cNum)
+
+	cUsbSlice := unsafe.Slice(cUsbs, int(cNum))
+
+	usbdevs = make([]DeviceUsbdev, cNum)
+	for i := range usbdevs {
+		if err = usbdevs[i].fromC(&cUsbSlice[i]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func boolToCInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
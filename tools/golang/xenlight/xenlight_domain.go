@@ -0,0 +1,509 @@
+/*
+ * Copyright (C) 2019 Nicolas Belouin, Gandi SAS
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+package xenlight
+
+/*
+#include <stdlib.h>
+#include <libxl.h>
+#include <libxl_utils.h>
+#include "xenlight_domain.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// DomainType mirrors libxl_domain_type: whether a domain is PV, a
+// traditional HVM guest, or a PVH guest.
+type DomainType int
+
+const (
+	DomainTypeInvalid DomainType = iota
+	DomainTypeHvm
+	DomainTypePv
+	DomainTypePvh
+)
+
+// DomainCreateInfo mirrors libxl_domain_create_info, the "c_info" half
+// of a domain config: the handful of properties that are fixed for the
+// lifetime of the domain (name, UUID, domain type, ...).
+type DomainCreateInfo struct {
+	Type    DomainType
+	Name    string
+	Uuid    [16]byte
+	Ssidref uint32
+}
+
+func (ci *DomainCreateInfo) toC() (cCi C.libxl_domain_create_info, err error) {
+	C.libxl_domain_create_info_init(&cCi)
+
+	cCi._type = C.libxl_domain_type(ci.Type)
+	cCi.ssidref = C.uint32_t(ci.Ssidref)
+
+	if ci.Name != "" {
+		cCi.name = C.CString(ci.Name)
+	}
+
+	for i, b := range ci.Uuid {
+		cCi.uuid[i] = C.uint8_t(b)
+	}
+
+	return
+}
+
+// DomainBuildInfo mirrors the common subset of libxl_domain_build_info
+// (the "b_info" half of a domain config) needed to boot a simple guest.
+// Kernel/Cmdline/Ramdisk only apply when Type is DomainTypePv.
+type DomainBuildInfo struct {
+	Type        DomainType
+	MaxVcpus    int
+	MaxMemkb    int64
+	TargetMemkb int64
+	Kernel      string
+	Cmdline     string
+	Ramdisk     string
+}
+
+func (bi *DomainBuildInfo) toC() (cBi C.libxl_domain_build_info, err error) {
+	C.libxl_domain_build_info_init(&cBi)
+
+	cBi._type = C.libxl_domain_type(bi.Type)
+	cBi.max_vcpus = C.int(bi.MaxVcpus)
+	cBi.max_memkb = C.int64_t(bi.MaxMemkb)
+	cBi.target_memkb = C.int64_t(bi.TargetMemkb)
+
+	if bi.Type == DomainTypePv {
+		var cKernel, cCmdline, cRamdisk *C.char
+
+		if bi.Kernel != "" {
+			cKernel = C.CString(bi.Kernel)
+			defer C.free(unsafe.Pointer(cKernel))
+		}
+		if bi.Cmdline != "" {
+			cCmdline = C.CString(bi.Cmdline)
+			defer C.free(unsafe.Pointer(cCmdline))
+		}
+		if bi.Ramdisk != "" {
+			cRamdisk = C.CString(bi.Ramdisk)
+			defer C.free(unsafe.Pointer(cRamdisk))
+		}
+
+		C.xenlight_build_info_set_pv(&cBi, cKernel, cCmdline, cRamdisk)
+	}
+
+	return
+}
+
+// DomainConfig is the Go-friendly mirror of libxl_domain_config: the
+// complete description of a domain, built up with zero-value defaults
+// and then passed to DomainCreateNew or DomainCreateRestore.
+type DomainConfig struct {
+	CInfo    DomainCreateInfo
+	BInfo    DomainBuildInfo
+	Disks    []DeviceDisk
+	Nics     []DeviceNic
+	Pcidevs  []DevicePci
+	Usbdevs  []DeviceUsbdev
+	Vfbs     []DeviceVfb
+	Vkbs     []DeviceVkb
+	Channels []DeviceChannel
+	Rdms     []DeviceRdm
+}
+
+// DeviceDisk mirrors libxl_device_disk, a block device attached to a
+// domain.
+type DeviceDisk struct {
+	Backend   Domid
+	Pdev      string
+	Vdev      string
+	Readwrite bool
+}
+
+func (disk *DeviceDisk) toC() (cDisk C.libxl_device_disk, err error) {
+	C.libxl_device_disk_init(&cDisk)
+
+	cDisk.backend_domid = C.uint32_t(disk.Backend)
+	cDisk.readwrite = C.int(boolToCInt(disk.Readwrite))
+
+	if disk.Pdev != "" {
+		cDisk.pdev_path = C.CString(disk.Pdev)
+	}
+	if disk.Vdev != "" {
+		cDisk.vdev = C.CString(disk.Vdev)
+	}
+
+	return
+}
+
+// DeviceVfb mirrors libxl_device_vfb, a virtual framebuffer.
+type DeviceVfb struct {
+	Backend Domid
+	Devid   Devid
+}
+
+func (vfb *DeviceVfb) toC() (cVfb C.libxl_device_vfb, err error) {
+	C.libxl_device_vfb_init(&cVfb)
+
+	cVfb.backend_domid = C.uint32_t(vfb.Backend)
+	cVfb.devid = C.int(vfb.Devid)
+
+	return
+}
+
+// DeviceVkb mirrors libxl_device_vkb, a virtual keyboard/mouse paired
+// with a DeviceVfb.
+type DeviceVkb struct {
+	Backend Domid
+	Devid   Devid
+}
+
+func (vkb *DeviceVkb) toC() (cVkb C.libxl_device_vkb, err error) {
+	C.libxl_device_vkb_init(&cVkb)
+
+	cVkb.backend_domid = C.uint32_t(vkb.Backend)
+	cVkb.devid = C.int(vkb.Devid)
+
+	return
+}
+
+// DeviceChannel mirrors libxl_device_channel, a virtio-console-style
+// byte stream between host and guest.
+type DeviceChannel struct {
+	Backend Domid
+	Devid   Devid
+	Name    string
+}
+
+func (ch *DeviceChannel) toC() (cCh C.libxl_device_channel, err error) {
+	C.libxl_device_channel_init(&cCh)
+
+	cCh.backend_domid = C.uint32_t(ch.Backend)
+	cCh.devid = C.int(ch.Devid)
+
+	if ch.Name != "" {
+		cCh.name = C.CString(ch.Name)
+	}
+
+	return
+}
+
+// DeviceRdm mirrors libxl_device_rdm, a reserved device memory region
+// carved out of the domain's address space for passed-through devices.
+type DeviceRdm struct {
+	Start uint64
+	Size  uint64
+}
+
+func (rdm *DeviceRdm) toC() (cRdm C.libxl_device_rdm, err error) {
+	C.libxl_device_rdm_init(&cRdm)
+
+	cRdm.start = C.uint64_t(rdm.Start)
+	cRdm.size = C.uint64_t(rdm.Size)
+
+	return
+}
+
+// validate checks the handful of invariants libxl itself would reject
+// a domain create for, before any of it crosses into C.
+func (d *DomainConfig) validate() error {
+	if d.CInfo.Type != DomainTypeHvm && d.CInfo.Type != DomainTypePv && d.CInfo.Type != DomainTypePvh {
+		return fmt.Errorf("xenlight: DomainConfig.CInfo.Type must be set to a valid DomainType")
+	}
+	if d.BInfo.MaxVcpus <= 0 {
+		return fmt.Errorf("xenlight: DomainConfig.BInfo.MaxVcpus must be positive")
+	}
+	if d.BInfo.MaxMemkb <= 0 {
+		return fmt.Errorf("xenlight: DomainConfig.BInfo.MaxMemkb must be positive")
+	}
+	if d.BInfo.TargetMemkb > d.BInfo.MaxMemkb {
+		return fmt.Errorf("xenlight: DomainConfig.BInfo.TargetMemkb cannot exceed MaxMemkb")
+	}
+
+	return nil
+}
+
+// toC always initializes cDc via libxl_domain_config_init before doing
+// anything else, so callers must unconditionally dispose of it, even
+// when err is non-nil: a failure partway through the Disks/Nics/
+// Pcidevs/Usbdevs/Vfbs/Vkbs/Channels/Rdms loops below still leaves any
+// already-calloc'd arrays hanging off cDc, and
+// libxl_domain_config_dispose is what frees them.
+func (d *DomainConfig) toC() (cDc C.libxl_domain_config, err error) {
+	C.libxl_domain_config_init(&cDc)
+
+	if err = d.validate(); err != nil {
+		return
+	}
+
+	cCi, err := d.CInfo.toC()
+	if err != nil {
+		return
+	}
+	cDc.c_info = cCi
+
+	cBi, err := d.BInfo.toC()
+	if err != nil {
+		return
+	}
+	cDc.b_info = cBi
+
+	if len(d.Disks) > 0 {
+		cDc.disks = (*C.libxl_device_disk)(C.calloc(C.size_t(len(d.Disks)), C.sizeof_libxl_device_disk))
+		cDc.num_disks = C.int(len(d.Disks))
+		cDisks := unsafe.Slice(cDc.disks, len(d.Disks))
+		for i, disk := range d.Disks {
+			if cDisks[i], err = disk.toC(); err != nil {
+				return
+			}
+		}
+	}
+
+	if len(d.Nics) > 0 {
+		cDc.nics = (*C.libxl_device_nic)(C.calloc(C.size_t(len(d.Nics)), C.sizeof_libxl_device_nic))
+		cDc.num_nics = C.int(len(d.Nics))
+		cNics := unsafe.Slice(cDc.nics, len(d.Nics))
+		for i, nic := range d.Nics {
+			if cNics[i], err = nic.toC(); err != nil {
+				return
+			}
+		}
+	}
+
+	if len(d.Pcidevs) > 0 {
+		cDc.pcidevs = (*C.libxl_device_pci)(C.calloc(C.size_t(len(d.Pcidevs)), C.sizeof_libxl_device_pci))
+		cDc.num_pcidevs = C.int(len(d.Pcidevs))
+		cPcis := unsafe.Slice(cDc.pcidevs, len(d.Pcidevs))
+		for i, pci := range d.Pcidevs {
+			if cPcis[i], err = pci.toC(); err != nil {
+				return
+			}
+		}
+	}
+
+	if len(d.Usbdevs) > 0 {
+		cDc.usbdevs = (*C.libxl_device_usbdev)(C.calloc(C.size_t(len(d.Usbdevs)), C.sizeof_libxl_device_usbdev))
+		cDc.num_usbdevs = C.int(len(d.Usbdevs))
+		cUsbdevs := unsafe.Slice(cDc.usbdevs, len(d.Usbdevs))
+		for i, usb := range d.Usbdevs {
+			if cUsbdevs[i], err = usb.toC(); err != nil {
+				return
+			}
+		}
+	}
+
+	if len(d.Vfbs) > 0 {
+		cDc.vfbs = (*C.libxl_device_vfb)(C.calloc(C.size_t(len(d.Vfbs)), C.sizeof_libxl_device_vfb))
+		cDc.num_vfbs = C.int(len(d.Vfbs))
+		cVfbs := unsafe.Slice(cDc.vfbs, len(d.Vfbs))
+		for i, vfb := range d.Vfbs {
+			if cVfbs[i], err = vfb.toC(); err != nil {
+				return
+			}
+		}
+	}
+
+	if len(d.Vkbs) > 0 {
+		cDc.vkbs = (*C.libxl_device_vkb)(C.calloc(C.size_t(len(d.Vkbs)), C.sizeof_libxl_device_vkb))
+		cDc.num_vkbs = C.int(len(d.Vkbs))
+		cVkbs := unsafe.Slice(cDc.vkbs, len(d.Vkbs))
+		for i, vkb := range d.Vkbs {
+			if cVkbs[i], err = vkb.toC(); err != nil {
+				return
+			}
+		}
+	}
+
+	if len(d.Channels) > 0 {
+		cDc.channels = (*C.libxl_device_channel)(C.calloc(C.size_t(len(d.Channels)), C.sizeof_libxl_device_channel))
+		cDc.num_channels = C.int(len(d.Channels))
+		cChannels := unsafe.Slice(cDc.channels, len(d.Channels))
+		for i, ch := range d.Channels {
+			if cChannels[i], err = ch.toC(); err != nil {
+				return
+			}
+		}
+	}
+
+	if len(d.Rdms) > 0 {
+		cDc.rdms = (*C.libxl_device_rdm)(C.calloc(C.size_t(len(d.Rdms)), C.sizeof_libxl_device_rdm))
+		cDc.num_rdms = C.int(len(d.Rdms))
+		cRdms := unsafe.Slice(cDc.rdms, len(d.Rdms))
+		for i, rdm := range d.Rdms {
+			if cRdms[i], err = rdm.toC(); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (d *DomainConfig) dispose(cDc *C.libxl_domain_config) {
+	C.libxl_domain_config_dispose(cDc)
+}
+
+// int libxl_domain_create_new(libxl_ctx *ctx, libxl_domain_config *d_config, uint32_t *domid, const libxl_asyncop_how *ao_how, const libxl_asyncprogress_how *aop_console_how);
+func (Ctx *Context) DomainCreateNew(config *DomainConfig) (Domid, error) {
+	return Ctx.domainCreate(config, false, 0)
+}
+
+// int libxl_domain_create_restore(libxl_ctx *ctx, libxl_domain_config *d_config, uint32_t *domid, int restore_fd, int send_back_fd, const libxl_domain_restore_params *params, const libxl_asyncop_how *ao_how, const libxl_asyncprogress_how *aop_console_how);
+func (Ctx *Context) DomainCreateRestore(config *DomainConfig, restoreFd int) (Domid, error) {
+	return Ctx.domainCreate(config, true, restoreFd)
+}
+
+func (Ctx *Context) domainCreate(config *DomainConfig, restore bool, restoreFd int) (id Domid, err error) {
+	cDc, err := config.toC()
+	defer config.dispose(&cDc)
+	if err != nil {
+		return
+	}
+
+	var cDomid C.uint32_t
+
+	var ret C.int
+	if restore {
+		ret = C.libxl_domain_create_restore(Ctx.ctx, &cDc, &cDomid,
+			C.int(restoreFd), -1, nil, nil, nil)
+	} else {
+		ret = C.libxl_domain_create_new(Ctx.ctx, &cDc, &cDomid, nil, nil)
+	}
+
+	if ret != 0 {
+		err = Error(-ret)
+		return
+	}
+
+	id = Domid(cDomid)
+
+	return
+}
+
+// int libxl_domain_shutdown(libxl_ctx *ctx, uint32_t domid);
+func (Ctx *Context) DomainShutdown(id Domid) error {
+	ret := C.libxl_domain_shutdown(Ctx.ctx, C.uint32_t(id))
+
+	return retErr(ret)
+}
+
+// int libxl_domain_reboot(libxl_ctx *ctx, uint32_t domid);
+func (Ctx *Context) DomainReboot(id Domid) error {
+	ret := C.libxl_domain_reboot(Ctx.ctx, C.uint32_t(id))
+
+	return retErr(ret)
+}
+
+// int libxl_domain_pause(libxl_ctx *ctx, uint32_t domid);
+func (Ctx *Context) DomainPause(id Domid) error {
+	ret := C.libxl_domain_pause(Ctx.ctx, C.uint32_t(id))
+
+	return retErr(ret)
+}
+
+// int libxl_domain_unpause(libxl_ctx *ctx, uint32_t domid);
+func (Ctx *Context) DomainUnpause(id Domid) error {
+	ret := C.libxl_domain_unpause(Ctx.ctx, C.uint32_t(id))
+
+	return retErr(ret)
+}
+
+// int libxl_domain_destroy(libxl_ctx *ctx, uint32_t domid, const libxl_asyncop_how *ao_how);
+func (Ctx *Context) DomainDestroy(id Domid) error {
+	ret := C.libxl_domain_destroy(Ctx.ctx, C.uint32_t(id), nil)
+
+	return retErr(ret)
+}
+
+// int libxl_domain_suspend(libxl_ctx *ctx, uint32_t domid, int fd, int flags, const libxl_asyncop_how *ao_how);
+func (Ctx *Context) DomainSuspend(id Domid, fd int) error {
+	ret := C.libxl_domain_suspend(Ctx.ctx, C.uint32_t(id), C.int(fd), 0, nil)
+
+	return retErr(ret)
+}
+
+// int libxl_domain_resume(libxl_ctx *ctx, uint32_t domid, int suspend_cancel, const libxl_asyncop_how *ao_how);
+func (Ctx *Context) DomainResume(id Domid) error {
+	ret := C.libxl_domain_resume(Ctx.ctx, C.uint32_t(id), 0, nil)
+
+	return retErr(ret)
+}
+
+// int libxl_domain_rename(libxl_ctx *ctx, uint32_t domid, const char *old_name, const char *new_name);
+func (Ctx *Context) DomainRename(id Domid, oldName, newName string) error {
+	cOld := C.CString(oldName)
+	defer C.free(unsafe.Pointer(cOld))
+	cNew := C.CString(newName)
+	defer C.free(unsafe.Pointer(cNew))
+
+	ret := C.libxl_domain_rename(Ctx.ctx, C.uint32_t(id), cOld, cNew)
+
+	return retErr(ret)
+}
+
+// DomainMigrate streams a live domain to a receiving libxl instance
+// listening on sendFd/recvFd, mirroring `xl migrate`'s use of
+// libxl_domain_suspend plus libxl_domain_create_restore on the far
+// side. The local domain is destroyed only after the remote side
+// writes a single non-zero byte to recvFd, acknowledging that its
+// libxl_domain_create_restore succeeded; any other outcome (a read
+// error, EOF, or a zero byte) leaves the local domain intact.
+func (Ctx *Context) DomainMigrate(id Domid, sendFd, recvFd int) error {
+	if sendFd < 0 || recvFd < 0 {
+		return fmt.Errorf("xenlight: DomainMigrate requires valid send/recv descriptors")
+	}
+
+	if err := Ctx.DomainSuspend(id, sendFd); err != nil {
+		return err
+	}
+
+	if err := waitMigrateConfirmation(recvFd); err != nil {
+		return fmt.Errorf("xenlight: domain %d suspended but remote side did not confirm receipt: %w", id, err)
+	}
+
+	return Ctx.DomainDestroy(id)
+}
+
+// waitMigrateConfirmation blocks until recvFd yields a single ack byte
+// from the receiving side. A non-zero byte means the migration
+// succeeded; anything else (a zero byte, a read error, or recvFd
+// closing early) is treated as failure.
+func waitMigrateConfirmation(recvFd int) error {
+	var ack [1]byte
+
+	for {
+		n, err := syscall.Read(recvFd, ack[:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("recv fd closed before sending a confirmation byte")
+		}
+		break
+	}
+
+	if ack[0] == 0 {
+		return fmt.Errorf("remote side reported migration failure")
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (C) 2019 Nicolas Belouin, Gandi SAS
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+package xenlight
+
+/*
+#include <stdlib.h>
+#include <libxl.h>
+#include <libxl_utils.h>
+#include "xenlight_event.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+)
+
+// EventType mirrors libxl_event_type: the kind of spontaneous event a
+// domain can raise between calls, as opposed to the completion of an
+// operation the caller itself kicked off.
+//
+// These values must track the libxl_event_type enum in libxl_event.h
+// exactly, since EventType is cast straight from C.libxl_event_type
+// (the same ABI-pinning treatment as Scheduler in xenlight_sched.go).
+type EventType int
+
+const (
+	EventTypeDomainShutdown    EventType = 1
+	EventTypeDomainDeath       EventType = 2
+	EventTypeDiskEject         EventType = 3
+	EventTypeOperationComplete EventType = 4
+)
+
+// eventTypeMask is the libxl_event_wait typemask bit for each event
+// type above; typemask is matched with bitwise AND, so listening for
+// "everything" means OR-ing every type's bit together, not passing 0.
+const eventTypeMask = (1 << uint(EventTypeDomainShutdown)) |
+	(1 << uint(EventTypeDomainDeath)) |
+	(1 << uint(EventTypeDiskEject)) |
+	(1 << uint(EventTypeOperationComplete))
+
+// Event mirrors the fields of libxl_event that Go callers care about.
+type Event struct {
+	Type  EventType
+	Domid Domid
+}
+
+// asyncOps maps the for_callback cookie handed to libxl on an async
+// call to the AsyncOp waiting on its completion.
+var (
+	asyncOpsMu   sync.Mutex
+	asyncOps     = make(map[uintptr]*AsyncOp)
+	asyncOpsNext uintptr
+)
+
+// AsyncOp tracks a libxl operation kicked off with a non-nil
+// libxl_asyncop_how. Done returns a channel that receives exactly once,
+// with nil on success or the completed operation's Error.
+type AsyncOp struct {
+	done   chan error
+	cookie uintptr
+}
+
+// Done returns the channel that AsyncOp's completion is posted to.
+func (op *AsyncOp) Done() <-chan error {
+	return op.done
+}
+
+// newAsyncOp registers a new AsyncOp under a fresh cookie and returns
+// the libxl_asyncop_how that callers should pass to the underlying
+// libxl_*_add/remove/etc call in place of nil.
+func newAsyncOp() (*AsyncOp, C.libxl_asyncop_how) {
+	op := &AsyncOp{done: make(chan error, 1)}
+
+	asyncOpsMu.Lock()
+	asyncOpsNext++
+	op.cookie = asyncOpsNext
+	asyncOps[op.cookie] = op
+	asyncOpsMu.Unlock()
+
+	var how C.libxl_asyncop_how
+	C.xenlight_asyncop_how_init(&how, C.uintptr_t(op.cookie))
+
+	return op, how
+}
+
+//export goAsyncOpCompleted
+func goAsyncOpCompleted(cookie C.uintptr_t, rc C.int) {
+	key := uintptr(cookie)
+
+	asyncOpsMu.Lock()
+	op, ok := asyncOps[key]
+	if ok {
+		delete(asyncOps, key)
+	}
+	asyncOpsMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if rc != 0 {
+		op.done <- Error(-rc)
+	} else {
+		op.done <- nil
+	}
+	close(op.done)
+}
+
+// eventQueues tracks the spontaneous-event channel for each Context
+// that has called EventRegisterCallbacks, keyed by Context pointer
+// identity so that Context itself need not carry event-loop state.
+var (
+	eventQueuesMu sync.Mutex
+	eventQueues   = make(map[*Context]chan Event)
+)
+
+// EventRegisterCallbacks starts a background goroutine that drains
+// libxl's spontaneous event queue (domain death, disk eject, and so
+// on) for Ctx, making them available via NextEvent. It must be called
+// once per Context before NextEvent is used, and before any
+// asynchronous call whose AsyncOp is expected to complete.
+func (Ctx *Context) EventRegisterCallbacks() error {
+	eventQueuesMu.Lock()
+	_, already := eventQueues[Ctx]
+	if !already {
+		eventQueues[Ctx] = make(chan Event, 16)
+	}
+	eventQueuesMu.Unlock()
+
+	if !already {
+		go Ctx.eventLoop()
+	}
+
+	return nil
+}
+
+func (Ctx *Context) eventLoop() {
+	eventQueuesMu.Lock()
+	queue := eventQueues[Ctx]
+	eventQueuesMu.Unlock()
+
+	// If libxl_event_wait ever returns an error, this goroutine exits
+	// and nobody else is pumping queue: remove it so NextEvent reports
+	// that registration is gone (instead of blocking forever) and
+	// EventRegisterCallbacks is free to start a fresh loop.
+	defer func() {
+		eventQueuesMu.Lock()
+		delete(eventQueues, Ctx)
+		eventQueuesMu.Unlock()
+	}()
+
+	for {
+		var cEvent *C.libxl_event
+
+		// eventTypeMask listens for every event type on every domain;
+		// NextEvent's caller is responsible for filtering.
+		ret := C.libxl_event_wait(Ctx.ctx, &cEvent, C.ulong(eventTypeMask), nil, nil)
+		if ret != 0 {
+			return
+		}
+
+		ev := Event{
+			Type:  EventType(cEvent._type),
+			Domid: Domid(cEvent.domid),
+		}
+		C.libxl_event_free(Ctx.ctx, cEvent)
+
+		select {
+		case queue <- ev:
+		default:
+			// Caller isn't keeping up; drop the oldest spontaneous
+			// event rather than block libxl's event thread.
+			select {
+			case <-queue:
+			default:
+			}
+			queue <- ev
+		}
+	}
+}
+
+// NextEvent blocks until a spontaneous libxl event (domain death, disk
+// eject, ...) is available and returns it. EventRegisterCallbacks must
+// have been called first.
+func (Ctx *Context) NextEvent() (Event, error) {
+	eventQueuesMu.Lock()
+	queue, ok := eventQueues[Ctx]
+	eventQueuesMu.Unlock()
+
+	if !ok {
+		return Event{}, fmt.Errorf("xenlight: EventRegisterCallbacks was not called")
+	}
+
+	return <-queue, nil
+}
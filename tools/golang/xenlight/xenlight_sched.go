@@ -0,0 +1,323 @@
+/*
+ * Copyright (C) 2019 Nicolas Belouin, Gandi SAS
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+package xenlight
+
+/*
+#include <stdlib.h>
+#include <libxl.h>
+#include <libxl_utils.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Scheduler mirrors libxl_scheduler: the CPU scheduler backing a
+// cpupool.
+type Scheduler int
+
+// These values must track the libxl_scheduler enum in libxl.h exactly,
+// since Scheduler is cast straight to/from C.libxl_scheduler.
+const (
+	SchedulerUnknown  Scheduler = 0
+	SchedulerCredit   Scheduler = 5
+	SchedulerCredit2  Scheduler = 6
+	SchedulerArinc653 Scheduler = 7
+	SchedulerRTDS     Scheduler = 8
+	SchedulerNull     Scheduler = 9
+)
+
+// String renders Scheduler the way xl and libxl_scheduler_to_string do.
+func (s Scheduler) String() string {
+	switch s {
+	case SchedulerCredit:
+		return "credit"
+	case SchedulerCredit2:
+		return "credit2"
+	case SchedulerRTDS:
+		return "rtds"
+	case SchedulerNull:
+		return "null"
+	case SchedulerArinc653:
+		return "arinc653"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseScheduler parses the scheduler names accepted by xl, mirroring
+// libxl_scheduler_from_string.
+func ParseScheduler(s string) (Scheduler, error) {
+	switch s {
+	case "credit":
+		return SchedulerCredit, nil
+	case "credit2":
+		return SchedulerCredit2, nil
+	case "rtds":
+		return SchedulerRTDS, nil
+	case "null":
+		return SchedulerNull, nil
+	case "arinc653":
+		return SchedulerArinc653, nil
+	}
+
+	return SchedulerUnknown, fmt.Errorf("xenlight: unknown scheduler %q", s)
+}
+
+// Cpupoolinfo mirrors libxl_cpupoolinfo: a cpupool's identity, the
+// scheduler it runs, and the cpus/domains assigned to it.
+type Cpupoolinfo struct {
+	Poolid  uint32
+	Name    string
+	Sched   Scheduler
+	CpuMap  Bitmap
+	NDomain int
+}
+
+// int libxl_cpupool_create(libxl_ctx *ctx, const char *name, libxl_scheduler sched, libxl_bitmap cpumap, libxl_uuid *uuid, uint32_t *poolid);
+//
+// A nil cpumap is passed to libxl as an empty bitmap, matching the
+// zero-valued cpumap xl itself sends when none was specified.
+func (Ctx *Context) CpupoolCreate(name string, sched Scheduler, cpumap *Bitmap) (uint32, error) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var cMap C.libxl_bitmap
+	C.libxl_bitmap_init(&cMap)
+	if cpumap != nil {
+		var err error
+		if cMap, err = cpumap.toC(Ctx); err != nil {
+			return 0, err
+		}
+		defer C.libxl_bitmap_dispose(&cMap)
+	}
+
+	var cUuid C.libxl_uuid
+	C.libxl_uuid_generate(&cUuid)
+
+	poolid := C.uint32_t(C.LIBXL_CPUPOOL_POOLID_ANY)
+
+	ret := C.libxl_cpupool_create(Ctx.ctx, cName, C.libxl_scheduler(sched),
+		cMap, &cUuid, &poolid)
+	if ret != 0 {
+		return 0, Error(-ret)
+	}
+
+	return uint32(poolid), nil
+}
+
+// int libxl_cpupool_destroy(libxl_ctx *ctx, uint32_t poolid);
+func (Ctx *Context) CpupoolDestroy(poolid uint32) error {
+	ret := C.libxl_cpupool_destroy(Ctx.ctx, C.uint32_t(poolid))
+
+	return retErr(ret)
+}
+
+// int libxl_cpupool_rename(libxl_ctx *ctx, const char *name, uint32_t poolid);
+func (Ctx *Context) CpupoolRename(poolid uint32, name string) error {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	ret := C.libxl_cpupool_rename(Ctx.ctx, cName, C.uint32_t(poolid))
+
+	return retErr(ret)
+}
+
+// int libxl_cpupool_cpuadd_cpumap(libxl_ctx *ctx, uint32_t poolid, const libxl_bitmap *cpumap);
+func (Ctx *Context) CpupoolCpuAdd(poolid uint32, cpumap *Bitmap) error {
+	if cpumap == nil {
+		return fmt.Errorf("xenlight: CpupoolCpuAdd requires a non-nil cpumap")
+	}
+
+	cMap, err := cpumap.toC(Ctx)
+	if err != nil {
+		return err
+	}
+	defer C.libxl_bitmap_dispose(&cMap)
+
+	ret := C.libxl_cpupool_cpuadd_cpumap(Ctx.ctx, C.uint32_t(poolid), &cMap)
+
+	return retErr(ret)
+}
+
+// int libxl_cpupool_cpuremove_cpumap(libxl_ctx *ctx, uint32_t poolid, const libxl_bitmap *cpumap);
+func (Ctx *Context) CpupoolCpuRemove(poolid uint32, cpumap *Bitmap) error {
+	if cpumap == nil {
+		return fmt.Errorf("xenlight: CpupoolCpuRemove requires a non-nil cpumap")
+	}
+
+	cMap, err := cpumap.toC(Ctx)
+	if err != nil {
+		return err
+	}
+	defer C.libxl_bitmap_dispose(&cMap)
+
+	ret := C.libxl_cpupool_cpuremove_cpumap(Ctx.ctx, C.uint32_t(poolid), &cMap)
+
+	return retErr(ret)
+}
+
+// int libxl_cpupool_movedomain(libxl_ctx *ctx, uint32_t poolid, uint32_t domid);
+func (Ctx *Context) CpupoolMovedomain(poolid uint32, domid Domid) error {
+	ret := C.libxl_cpupool_movedomain(Ctx.ctx, C.uint32_t(poolid), C.uint32_t(domid))
+
+	return retErr(ret)
+}
+
+// libxl_cpupoolinfo *libxl_list_cpupool(libxl_ctx *ctx, int *nb_pool_out);
+func (Ctx *Context) CpupoolInfoList() (pools []Cpupoolinfo, err error) {
+	var cNum C.int
+
+	cPools := C.libxl_list_cpupool(Ctx.ctx, &cNum)
+	if cPools == nil {
+		return
+	}
+	defer C.libxl_cpupoolinfo_list_free(cPools, cNum)
+
+	cSlice := unsafe.Slice(cPools, int(cNum))
+
+	pools = make([]Cpupoolinfo, cNum)
+	for i := range pools {
+		pools[i].Poolid = uint32(cSlice[i].poolid)
+		pools[i].Name = C.GoString(cSlice[i].pool_name)
+		pools[i].Sched = Scheduler(cSlice[i].sched)
+		pools[i].NDomain = int(cSlice[i].n_dom)
+		pools[i].CpuMap.fromC(&cSlice[i].cpumap)
+	}
+
+	return
+}
+
+// SchedCreditParams mirrors libxl_sched_credit_params: the weight/cap
+// pair used by the credit scheduler, read and written per cpupool.
+type SchedCreditParams struct {
+	Weight int
+	Cap    int
+}
+
+// int libxl_sched_credit_params_get(libxl_ctx *ctx, uint32_t poolid, libxl_sched_credit_params *scinfo);
+func (Ctx *Context) SchedCreditParamsGet(poolid uint32) (params SchedCreditParams, err error) {
+	var cParams C.libxl_sched_credit_params
+
+	ret := C.libxl_sched_credit_params_get(Ctx.ctx, C.uint32_t(poolid), &cParams)
+	if ret != 0 {
+		err = Error(-ret)
+		return
+	}
+
+	params = SchedCreditParams{
+		Weight: int(cParams.weight),
+		Cap:    int(cParams.cap),
+	}
+
+	return
+}
+
+// int libxl_sched_credit_params_set(libxl_ctx *ctx, uint32_t poolid, libxl_sched_credit_params *scinfo);
+func (Ctx *Context) SchedCreditParamsSet(poolid uint32, params SchedCreditParams) error {
+	cParams := C.libxl_sched_credit_params{
+		weight: C.int(params.Weight),
+		cap:    C.int(params.Cap),
+	}
+
+	ret := C.libxl_sched_credit_params_set(Ctx.ctx, C.uint32_t(poolid), &cParams)
+
+	return retErr(ret)
+}
+
+// SchedCredit2Params mirrors libxl_sched_credit2_params: the per-pool
+// ratelimit used by the credit2 scheduler.
+type SchedCredit2Params struct {
+	RatelimitUs int
+}
+
+// int libxl_sched_credit2_params_get(libxl_ctx *ctx, uint32_t poolid, libxl_sched_credit2_params *scinfo);
+func (Ctx *Context) SchedCredit2ParamsGet(poolid uint32) (params SchedCredit2Params, err error) {
+	var cParams C.libxl_sched_credit2_params
+
+	ret := C.libxl_sched_credit2_params_get(Ctx.ctx, C.uint32_t(poolid), &cParams)
+	if ret != 0 {
+		err = Error(-ret)
+		return
+	}
+
+	params = SchedCredit2Params{RatelimitUs: int(cParams.ratelimit_us)}
+
+	return
+}
+
+// int libxl_sched_credit2_params_set(libxl_ctx *ctx, uint32_t poolid, libxl_sched_credit2_params *scinfo);
+func (Ctx *Context) SchedCredit2ParamsSet(poolid uint32, params SchedCredit2Params) error {
+	cParams := C.libxl_sched_credit2_params{
+		ratelimit_us: C.int(params.RatelimitUs),
+	}
+
+	ret := C.libxl_sched_credit2_params_set(Ctx.ctx, C.uint32_t(poolid), &cParams)
+
+	return retErr(ret)
+}
+
+// DomainSchedParams mirrors libxl_domain_sched_params: the tunables
+// that apply to a single domain, interpreted according to whichever
+// scheduler its cpupool runs (weight/cap for credit and credit2,
+// period/budget for RTDS).
+type DomainSchedParams struct {
+	Weight int
+	Cap    int
+	Period int
+	Budget int
+}
+
+// int libxl_domain_sched_params_get(libxl_ctx *ctx, uint32_t domid, libxl_domain_sched_params *params);
+func (Ctx *Context) DomainSchedParamsGet(domid Domid) (params DomainSchedParams, err error) {
+	var cParams C.libxl_domain_sched_params
+	C.libxl_domain_sched_params_init(&cParams)
+	defer C.libxl_domain_sched_params_dispose(&cParams)
+
+	ret := C.libxl_domain_sched_params_get(Ctx.ctx, C.uint32_t(domid), &cParams)
+	if ret != 0 {
+		err = Error(-ret)
+		return
+	}
+
+	params = DomainSchedParams{
+		Weight: int(cParams.weight),
+		Cap:    int(cParams.cap),
+		Period: int(cParams.period),
+		Budget: int(cParams.budget),
+	}
+
+	return
+}
+
+// int libxl_domain_sched_params_set(libxl_ctx *ctx, uint32_t domid, const libxl_domain_sched_params *params);
+func (Ctx *Context) DomainSchedParamsSet(domid Domid, params DomainSchedParams) error {
+	var cParams C.libxl_domain_sched_params
+	C.libxl_domain_sched_params_init(&cParams)
+	defer C.libxl_domain_sched_params_dispose(&cParams)
+
+	cParams.weight = C.int(params.Weight)
+	cParams.cap = C.int(params.Cap)
+	cParams.period = C.int(params.Period)
+	cParams.budget = C.int(params.Budget)
+
+	ret := C.libxl_domain_sched_params_set(Ctx.ctx, C.uint32_t(domid), &cParams)
+
+	return retErr(ret)
+}
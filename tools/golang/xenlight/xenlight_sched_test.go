@@ -0,0 +1,51 @@
+/*
+ * Copyright (C) 2019 Nicolas Belouin, Gandi SAS
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+package xenlight
+
+import "testing"
+
+func TestSchedulerStringParseRoundTrip(t *testing.T) {
+	scheds := []Scheduler{
+		SchedulerCredit,
+		SchedulerCredit2,
+		SchedulerRTDS,
+		SchedulerNull,
+		SchedulerArinc653,
+	}
+
+	for _, s := range scheds {
+		parsed, err := ParseScheduler(s.String())
+		if err != nil {
+			t.Fatalf("ParseScheduler(%q): %v", s.String(), err)
+		}
+		if parsed != s {
+			t.Errorf("round trip of %v: got %v", s, parsed)
+		}
+	}
+}
+
+func TestSchedulerStringUnknown(t *testing.T) {
+	if got := Scheduler(-1).String(); got != "unknown" {
+		t.Errorf("Scheduler(-1).String() = %q, want %q", got, "unknown")
+	}
+}
+
+func TestParseSchedulerInvalid(t *testing.T) {
+	if _, err := ParseScheduler("not-a-scheduler"); err == nil {
+		t.Fatalf("ParseScheduler should reject an unknown name")
+	}
+}
@@ -0,0 +1,354 @@
+/*
+ * Copyright (C) 2019 Nicolas Belouin, Gandi SAS
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+package xenlight
+
+/*
+#include <stdlib.h>
+#include <libxl.h>
+#include <libxl_utils.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Bitmap mirrors libxl_bitmap: a variable-length bitmap used
+// throughout libxl for cpumaps and nodemaps.
+type Bitmap struct {
+	bits []byte
+}
+
+// NewBitmap returns a Bitmap with room for at least nbits bits, all
+// initially clear.
+func NewBitmap(nbits int) *Bitmap {
+	return &Bitmap{bits: make([]byte, (nbits+7)/8)}
+}
+
+// Set sets bit i, growing the Bitmap if necessary.
+func (b *Bitmap) Set(i int) {
+	b.grow(i)
+	b.bits[i/8] |= 1 << uint(i%8)
+}
+
+// Clear clears bit i. It is a no-op if i is out of range.
+func (b *Bitmap) Clear(i int) {
+	if i/8 >= len(b.bits) {
+		return
+	}
+	b.bits[i/8] &^= 1 << uint(i%8)
+}
+
+// Test reports whether bit i is set.
+func (b *Bitmap) Test(i int) bool {
+	if i/8 >= len(b.bits) {
+		return false
+	}
+	return b.bits[i/8]&(1<<uint(i%8)) != 0
+}
+
+// SetRange sets every bit in [start, end], inclusive.
+func (b *Bitmap) SetRange(start, end int) {
+	for i := start; i <= end; i++ {
+		b.Set(i)
+	}
+}
+
+func (b *Bitmap) grow(i int) {
+	need := i/8 + 1
+	if need <= len(b.bits) {
+		return
+	}
+	grown := make([]byte, need)
+	copy(grown, b.bits)
+	b.bits = grown
+}
+
+// String renders the Bitmap using the cpumap syntax accepted by xl,
+// as a comma-separated list of the set bits and ranges, e.g. "0,2-3,7".
+// It never emits "^" entries.
+func (b *Bitmap) String() string {
+	var set []int
+	for i := 0; i < len(b.bits)*8; i++ {
+		if b.Test(i) {
+			set = append(set, i)
+		}
+	}
+	if len(set) == 0 {
+		return ""
+	}
+
+	var ranges []string
+	start := set[0]
+	prev := set[0]
+	for _, i := range set[1:] {
+		if i == prev+1 {
+			prev = i
+			continue
+		}
+		ranges = append(ranges, formatRange(start, prev))
+		start, prev = i, i
+	}
+	ranges = append(ranges, formatRange(start, prev))
+
+	return strings.Join(ranges, ",")
+}
+
+func formatRange(start, end int) string {
+	if start == end {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d-%d", start, end)
+}
+
+// ParseBitmap parses the cpumap syntax accepted by xl ("0-3,^1,7") into
+// a Bitmap. A leading "^" on an entry clears that bit/range instead of
+// setting it, so entries are applied in order.
+func ParseBitmap(s string) (*Bitmap, error) {
+	b := NewBitmap(0)
+
+	if strings.TrimSpace(s) == "" {
+		return b, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		clear := strings.HasPrefix(entry, "^")
+		entry = strings.TrimPrefix(entry, "^")
+
+		start, end, err := parseRange(entry)
+		if err != nil {
+			return nil, fmt.Errorf("xenlight: invalid cpumap entry %q: %w", entry, err)
+		}
+
+		if clear {
+			for i := start; i <= end; i++ {
+				b.Clear(i)
+			}
+		} else {
+			b.SetRange(start, end)
+		}
+	}
+
+	return b, nil
+}
+
+func parseRange(entry string) (start, end int, err error) {
+	parts := strings.SplitN(entry, "-", 2)
+
+	start, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return
+	}
+
+	if len(parts) == 1 {
+		end = start
+		return
+	}
+
+	end, err = strconv.Atoi(parts[1])
+
+	return
+}
+
+func (b *Bitmap) toC(Ctx *Context) (cBitmap C.libxl_bitmap, err error) {
+	C.libxl_bitmap_init(&cBitmap)
+
+	if len(b.bits) == 0 {
+		return
+	}
+
+	if rc := C.libxl_bitmap_alloc(Ctx.ctx, &cBitmap, C.int(len(b.bits)*8)); rc != 0 {
+		err = Error(-rc)
+		return
+	}
+
+	cBytes := unsafe.Slice(cBitmap.map_, int(cBitmap.size))
+	copy(cBytes, b.bits)
+
+	return
+}
+
+func (b *Bitmap) fromC(cBitmap *C.libxl_bitmap) {
+	size := int(cBitmap.size)
+	b.bits = make([]byte, size)
+
+	if size == 0 {
+		return
+	}
+
+	cBytes := unsafe.Slice(cBitmap.map_, size)
+	copy(b.bits, cBytes)
+}
+
+// Vcpuinfo mirrors libxl_vcpuinfo: the runtime state of a single
+// domain vcpu.
+type Vcpuinfo struct {
+	Vcpuid     uint32
+	Cpu        uint32
+	Online     bool
+	Blocked    bool
+	Running    bool
+	CPUTime    uint64
+	CPUMapHard Bitmap
+	CPUMapSoft Bitmap
+}
+
+// libxl_vcpuinfo *libxl_list_vcpu(libxl_ctx *ctx, uint32_t domid, int *nb_vcpu, int *nr_cpus_out);
+func (Ctx *Context) ListVcpu(id Domid) (vcpus []Vcpuinfo, err error) {
+	var cNumVcpu, cNumCpu C.int
+
+	cVcpus := C.libxl_list_vcpu(Ctx.ctx, C.uint32_t(id), &cNumVcpu, &cNumCpu)
+	if cVcpus == nil {
+		return
+	}
+	defer C.libxl_vcpuinfo_list_free(cVcpus, cNumVcpu)
+
+	cVcpuSlice := unsafe.Slice(cVcpus, int(cNumVcpu))
+
+	vcpus = make([]Vcpuinfo, cNumVcpu)
+	for i := range vcpus {
+		vcpus[i].Vcpuid = uint32(cVcpuSlice[i].vcpuid)
+		vcpus[i].Cpu = uint32(cVcpuSlice[i].cpu)
+		vcpus[i].Online = bool(cVcpuSlice[i].online)
+		vcpus[i].Blocked = bool(cVcpuSlice[i].blocked)
+		vcpus[i].Running = bool(cVcpuSlice[i].running)
+		vcpus[i].CPUTime = uint64(cVcpuSlice[i].vcpu_time)
+		vcpus[i].CPUMapHard.fromC(&cVcpuSlice[i].cpumap)
+		vcpus[i].CPUMapSoft.fromC(&cVcpuSlice[i].cpumap_soft)
+	}
+
+	return
+}
+
+// int libxl_set_vcpuaffinity(libxl_ctx *ctx, uint32_t domid, uint32_t vcpuid, const libxl_bitmap *cpumap_hard, const libxl_bitmap *cpumap_soft, unsigned flags);
+func (Ctx *Context) SetVcpuAffinity(id Domid, vcpu uint32, hard, soft *Bitmap) error {
+	var cHard, cSoft C.libxl_bitmap
+	var cHardPtr, cSoftPtr *C.libxl_bitmap
+
+	if hard != nil {
+		var err error
+		if cHard, err = hard.toC(Ctx); err != nil {
+			return err
+		}
+		defer C.libxl_bitmap_dispose(&cHard)
+		cHardPtr = &cHard
+	}
+
+	if soft != nil {
+		var err error
+		if cSoft, err = soft.toC(Ctx); err != nil {
+			return err
+		}
+		defer C.libxl_bitmap_dispose(&cSoft)
+		cSoftPtr = &cSoft
+	}
+
+	ret := C.libxl_set_vcpuaffinity(Ctx.ctx, C.uint32_t(id), C.uint32_t(vcpu), cHardPtr, cSoftPtr, 0)
+
+	return retErr(ret)
+}
+
+// int libxl_set_vcpuonline(libxl_ctx *ctx, uint32_t domid, const libxl_bitmap *cpumap);
+func (Ctx *Context) SetVcpuOnline(id Domid, mask *Bitmap) error {
+	cMask, err := mask.toC(Ctx)
+	if err != nil {
+		return err
+	}
+	defer C.libxl_bitmap_dispose(&cMask)
+
+	ret := C.libxl_set_vcpuonline(Ctx.ctx, C.uint32_t(id), &cMask)
+
+	return retErr(ret)
+}
+
+// Physinfo mirrors libxl_physinfo: a summary of the host's physical
+// resources.
+type Physinfo struct {
+	ThreadsPerCore uint32
+	CoresPerSocket uint32
+	MaxCpuID       uint32
+	NrCpus         uint32
+	CpuKhz         uint32
+	TotalPages     uint64
+	FreePages      uint64
+	ScrubPages     uint64
+	NrNodes        uint32
+}
+
+// int libxl_get_physinfo(libxl_ctx *ctx, libxl_physinfo *physinfo);
+func (Ctx *Context) GetPhysinfo() (info Physinfo, err error) {
+	var cInfo C.libxl_physinfo
+	C.libxl_physinfo_init(&cInfo)
+	defer C.libxl_physinfo_dispose(&cInfo)
+
+	ret := C.libxl_get_physinfo(Ctx.ctx, &cInfo)
+	if ret != 0 {
+		err = Error(-ret)
+		return
+	}
+
+	info = Physinfo{
+		ThreadsPerCore: uint32(cInfo.threads_per_core),
+		CoresPerSocket: uint32(cInfo.cores_per_socket),
+		MaxCpuID:       uint32(cInfo.max_cpu_id),
+		NrCpus:         uint32(cInfo.nr_cpus),
+		CpuKhz:         uint32(cInfo.cpu_khz),
+		TotalPages:     uint64(cInfo.total_pages),
+		FreePages:      uint64(cInfo.free_pages),
+		ScrubPages:     uint64(cInfo.scrub_pages),
+		NrNodes:        uint32(cInfo.nr_nodes),
+	}
+
+	return
+}
+
+// Cputopology mirrors libxl_cputopology: which core/socket/node a
+// given physical cpu belongs to.
+type Cputopology struct {
+	Core   uint32
+	Socket uint32
+	Node   uint32
+}
+
+// libxl_cputopology *libxl_get_cpu_topology(libxl_ctx *ctx, int *nb_cpu_out);
+func (Ctx *Context) GetCpuTopology() (topology []Cputopology, err error) {
+	var cNum C.int
+
+	cTopology := C.libxl_get_cpu_topology(Ctx.ctx, &cNum)
+	if cTopology == nil {
+		err = fmt.Errorf("xenlight: libxl_get_cpu_topology failed")
+		return
+	}
+	defer C.libxl_cputopology_list_free(cTopology, cNum)
+
+	cSlice := unsafe.Slice(cTopology, int(cNum))
+
+	topology = make([]Cputopology, cNum)
+	for i := range topology {
+		topology[i] = Cputopology{
+			Core:   uint32(cSlice[i].core),
+			Socket: uint32(cSlice[i].socket),
+			Node:   uint32(cSlice[i].node),
+		}
+	}
+
+	return
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2019 Nicolas Belouin, Gandi SAS
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation;
+ * version 2.1 of the License.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; If not, see <http://www.gnu.org/licenses/>.
+ */
+package xenlight
+
+import "testing"
+
+func TestBitmapSetClearTest(t *testing.T) {
+	b := NewBitmap(4)
+
+	if b.Test(2) {
+		t.Fatalf("bit 2 should start clear")
+	}
+
+	b.Set(2)
+	if !b.Test(2) {
+		t.Fatalf("bit 2 should be set")
+	}
+
+	b.Clear(2)
+	if b.Test(2) {
+		t.Fatalf("bit 2 should be clear after Clear")
+	}
+}
+
+func TestBitmapSetGrows(t *testing.T) {
+	b := NewBitmap(0)
+
+	b.Set(17)
+	if !b.Test(17) {
+		t.Fatalf("Set should grow the bitmap to fit bit 17")
+	}
+}
+
+func TestBitmapSetRange(t *testing.T) {
+	b := NewBitmap(8)
+	b.SetRange(1, 3)
+
+	for i := 0; i < 8; i++ {
+		want := i >= 1 && i <= 3
+		if got := b.Test(i); got != want {
+			t.Errorf("bit %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestBitmapStringRoundTrip(t *testing.T) {
+	cases := []string{
+		"",
+		"0",
+		"0-3",
+		"0-3,7",
+		"0-3,^1,7",
+	}
+
+	for _, s := range cases {
+		b, err := ParseBitmap(s)
+		if err != nil {
+			t.Fatalf("ParseBitmap(%q): %v", s, err)
+		}
+
+		got := b.String()
+
+		b2, err := ParseBitmap(got)
+		if err != nil {
+			t.Fatalf("ParseBitmap(%q) (round trip of %q): %v", got, s, err)
+		}
+
+		if b2.String() != got {
+			t.Errorf("round trip of %q: got %q, then %q", s, got, b2.String())
+		}
+	}
+}
+
+func TestParseBitmapClearEntry(t *testing.T) {
+	b, err := ParseBitmap("0-3,^1,7")
+	if err != nil {
+		t.Fatalf("ParseBitmap: %v", err)
+	}
+
+	want := map[int]bool{0: true, 1: false, 2: true, 3: true, 7: true}
+	for i, w := range want {
+		if got := b.Test(i); got != w {
+			t.Errorf("bit %d: got %v, want %v", i, got, w)
+		}
+	}
+}
+
+func TestParseBitmapInvalid(t *testing.T) {
+	if _, err := ParseBitmap("not-a-number"); err == nil {
+		t.Fatalf("ParseBitmap should reject a non-numeric entry")
+	}
+}